@@ -17,36 +17,86 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/influxdata/influxdb/client/v2"
+	"github.com/jpillora/backoff"
 	"github.com/urfave/cli" // renamed from codegansta
 	"math/rand"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	VERSION        string  = "2016-09-07"
-	DEF_DB         string  = "custom"
-	DEF_HOSTPREFIX string  = "hetsfan"
-	DEF_TIMEOUT    float64 = 66.6
-	DEF_W_TIMEOUT  float64 = 5.0
-	DEF_INTERVAL   float64 = 1.3
-	DEF_POINTS     uint    = 256
-	DEF_NUMHOSTS   uint    = 64
+	VERSION           string  = "2016-09-07"
+	DEF_DB            string  = "custom"
+	DEF_HOSTPREFIX    string  = "hetsfan"
+	DEF_TIMEOUT       float64 = 66.6
+	DEF_W_TIMEOUT     float64 = 5.0
+	DEF_INTERVAL      float64 = 1.3
+	DEF_POINTS        uint    = 256
+	DEF_NUMHOSTS      uint    = 64
+	DEF_OUTPUT        string  = "influx"
+	DEF_MQTT_TOPIC    string  = "influx-killer"
+	DEF_MQTT_QOS      uint    = 0
+	DEF_MQTT_CLIENTID string  = "influx-killer"
+	DEF_MIN_BACKOFF   float64 = 1.0
+	DEF_MAX_BACKOFF   float64 = 60.0
+	DEF_FAIL_FAST     int     = 0
+	DEF_PROTOCOL      string  = "http"
+	DEF_PAYLOAD_SIZE  int     = 512
+	DEF_MEASUREMENT   string  = "cpu_usage"
 )
 
 type Worker struct {
-	Client    client.Client
+	Writer    PointWriter
 	Hostname  string
-	DB        string
 	NumPoints int
 	Interval  time.Duration
-	Done      chan bool
-	Cancel    chan bool
+	Backoff   *backoff.Backoff
+	FailFast  int
+	Failures  int
+	Schema    *RuntimeSchema
+	Stats     *Stats
+
+	// pending holds the size of the last batch that failed to write. The
+	// failed points are not resent: the next write builds a fresh batch,
+	// and a successful one clears pending. If the worker stops first
+	// (cancelled while sitting in backoff, or given up by --fail-fast),
+	// those points are reported as dropped instead of silently vanishing.
+	pending int
+}
+
+// WorkerConfig groups everything NewWorker needs to build a Worker and its
+// PointWriter. It exists because the writer/backoff/schema features each
+// added their own construction parameters, to the point where a positional
+// arg list stopped being readable.
+type WorkerConfig struct {
+	Hostname    string
+	Output      string
+	Protocol    string
+	PayloadSize int
+	DB          string
+	URL         string
+	NumPoints   int
+	Interval    float64
+	Timeout     float64
+	MinBackoff  float64
+	MaxBackoff  float64
+	FailFast    int
+	Schema      *RuntimeSchema
+	Stats       *Stats
+
+	MQTTBroker         string
+	MQTTTopicPrefix    string
+	MQTTUsername       string
+	MQTTPassword       string
+	MQTTClientIDPrefix string
+	MQTTQoS            uint
 }
 
 var regions = [...]string{
@@ -56,21 +106,16 @@ var regions = [...]string{
 	"us-east-2",
 }
 
-func (w *Worker) Work() {
+// Work runs the worker's write loop until ctx is cancelled (or until
+// --fail-fast gives up after too many consecutive failures), then closes
+// its Writer and returns. wg.Done is called exactly once, on return, so
+// the caller can block on wg.Wait() for a clean shutdown.
+func (w *Worker) Work(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for {
 		select {
-		case <-w.Cancel:
-			log.WithFields(log.Fields{
-				"worker": w.Hostname,
-			}).Debug("Quitting...")
-			err := w.Client.Close()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"worker": w.Hostname,
-					"error":  err,
-				}).Error("Client close")
-			}
-			w.Done <- true
+		case <-ctx.Done():
+			w.quit()
 			return
 		default:
 			// carry on
@@ -79,35 +124,125 @@ func (w *Worker) Work() {
 			"worker":     w.Hostname,
 			"num_points": w.NumPoints,
 		}).Debug("Writing...")
-		err := w.Write()
+		n, err := w.Write()
 		if err != nil {
+			w.Failures++
+			w.pending = n
 			log.WithFields(log.Fields{
-				"worker": w.Hostname,
-				"error":  err,
+				"worker":          w.Hostname,
+				"error":           err,
+				"backoff_attempt": w.Failures,
 			}).Error("Client write")
+			if w.FailFast > 0 && w.Failures >= w.FailFast {
+				log.WithFields(log.Fields{
+					"worker":   w.Hostname,
+					"failures": w.Failures,
+				}).Error("Giving up after too many consecutive failures")
+				w.quit()
+				return
+			}
+			d := w.Backoff.Duration()
+			log.WithFields(log.Fields{
+				"worker":          w.Hostname,
+				"backoff_attempt": w.Failures,
+				"backoff":         d,
+			}).Debug("Backing off...")
+			if !sleep(ctx, d) {
+				w.quit()
+				return
+			}
+			continue
 		}
+		w.Failures = 0
+		w.pending = 0
+		w.Backoff.Reset()
 		log.WithFields(log.Fields{
 			"worker":   w.Hostname,
 			"interval": w.Interval,
 		}).Debug("Sleeping...")
-		time.Sleep(w.Interval)
+		if !sleep(ctx, w.Interval) {
+			w.quit()
+			return
+		}
 	}
 }
 
-// inspired (almost copied) by https://github.com/influxdata/influxdb/blob/master/client/README.md
-func (w *Worker) Write() error {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  w.DB,
-		Precision: "ms",
-	})
-	if err != nil {
+// quit drains any pending batch (points from the last write, which
+// failed and was not followed by a successful one), reports it as
+// dropped, then closes the
+// worker's Writer, logging (but not failing) on error.
+func (w *Worker) quit() {
+	if w.pending > 0 {
+		log.WithFields(log.Fields{
+			"worker":         w.Hostname,
+			"points_dropped": w.pending,
+		}).Warn("Dropping unretried batch on shutdown")
+		if w.Stats != nil {
+			w.Stats.RecordDrop(w.pending)
+		}
+		w.pending = 0
+	}
+	log.WithFields(log.Fields{
+		"worker": w.Hostname,
+	}).Debug("Quitting...")
+	if err := w.Writer.Close(); err != nil {
 		log.WithFields(log.Fields{
 			"worker": w.Hostname,
 			"error":  err,
-		}).Error("Create batch points")
-		return err
+		}).Error("Client close")
 	}
+}
+
+// sleep waits for d or ctx cancellation, whichever comes first. It
+// reports false if ctx was cancelled first, so callers can bail out
+// promptly instead of finishing out a stale sleep.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Write builds this tick's points and hands them to the Writer, recording
+// latency and outcome in Stats along the way. It returns the number of
+// points in the attempted batch so the caller can track it as pending
+// until the next successful write clears it.
+func (w *Worker) Write() (int, error) {
+	points, err := w.buildPoints()
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	err = w.Writer.Write(points)
+	if w.Stats != nil {
+		w.Stats.RecordWrite(len(points), time.Since(start), err)
+	}
+	return len(points), err
+}
+
+// buildPoints generates one tick's worth of points, either from the
+// worker's assigned schema or (inspired/almost copied from
+// https://github.com/influxdata/influxdb/blob/master/client/README.md)
+// the hard-coded default cpu_usage schema.
+func (w *Worker) buildPoints() ([]*client.Point, error) {
+	if w.Schema != nil {
+		points, err := w.Schema.Points(w.Hostname)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"worker":      w.Hostname,
+				"measurement": w.Schema.Measurement,
+				"error":       err,
+			}).Error("Create point")
+			return nil, err
+		}
+		return points, nil
+	}
+
 	max := 100.0
+	points := make([]*client.Point, 0, w.NumPoints)
 	for i := 0; i < w.NumPoints; i++ {
 		tags := map[string]string{
 			"cpu":    "cpu-total",
@@ -119,39 +254,42 @@ func (w *Worker) Write() error {
 			"idle": idle,
 			"busy": max - idle,
 		}
-		p, err := client.NewPoint("cpu_usage", tags, fields, time.Now())
+		p, err := client.NewPoint(DEF_MEASUREMENT, tags, fields, time.Now())
 		if err != nil {
 			log.WithFields(log.Fields{
 				"worker": w.Hostname,
 				"error":  err,
 			}).Error("Create point")
-			return err
+			return nil, err
 		}
-		bp.AddPoint(p)
+		points = append(points, p)
 	}
-	return w.Client.Write(bp)
+	return points, nil
 }
 
-func NewWorker(hostname, db, addr string, numpoints int, interval, timeout float64, cancel, done chan bool) *Worker {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:    addr,
-		Timeout: time.Duration(timeout*1000) * time.Millisecond,
-	})
+func NewWorker(cfg WorkerConfig) *Worker {
+	measurement := DEF_MEASUREMENT
+	if cfg.Schema != nil {
+		measurement = cfg.Schema.Measurement
+	}
+	wr, err := newWriters(cfg.Output, cfg.Protocol, cfg.Hostname, cfg.URL, cfg.DB, cfg.Timeout, cfg.PayloadSize, cfg.MQTTBroker, cfg.MQTTTopicPrefix, cfg.MQTTUsername, cfg.MQTTPassword, cfg.MQTTClientIDPrefix, measurement, cfg.MQTTQoS)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"worker": hostname,
-			"error":  err,
-		}).Error("Create HTTP client")
 		return nil
 	}
 	return &Worker{
-		Client:    c,
-		Hostname:  hostname,
-		DB:        db,
-		NumPoints: numpoints,
-		Interval:  time.Duration(interval*1000) * time.Millisecond,
-		Cancel:    cancel,
-		Done:      done,
+		Writer:    wr,
+		Hostname:  cfg.Hostname,
+		NumPoints: cfg.NumPoints,
+		Interval:  time.Duration(cfg.Interval*1000) * time.Millisecond,
+		Backoff: &backoff.Backoff{
+			Min:    time.Duration(cfg.MinBackoff*1000) * time.Millisecond,
+			Max:    time.Duration(cfg.MaxBackoff*1000) * time.Millisecond,
+			Factor: 2,
+			Jitter: true,
+		},
+		FailFast: cfg.FailFast,
+		Schema:   cfg.Schema,
+		Stats:    cfg.Stats,
 	}
 }
 
@@ -164,56 +302,138 @@ func startStress(c *cli.Context) error {
 	db := c.String("db")
 	url := c.String("url")
 	wto := c.Float64("write-timeout")
+	output := c.String("output")
+	mqttBroker := c.String("mqtt-broker")
+	mqttTopic := c.String("mqtt-topic")
+	mqttQoS := c.Uint("mqtt-qos")
+	mqttUsername := c.String("mqtt-username")
+	mqttPassword := c.String("mqtt-password")
+	mqttClientIDPrefix := c.String("mqtt-client-id-prefix")
+	minBackoff := c.Float64("min-backoff")
+	maxBackoff := c.Float64("max-backoff")
+	failFast := c.Int("fail-fast")
+	configPath := c.String("config")
+	protocol := c.String("protocol")
+	payloadSize := c.Int("payload-size")
+	statsAddr := c.String("stats-addr")
 
-	if url == "" {
+	if output != "influx" && output != "mqtt" && output != "both" {
+		return cli.NewExitError("--output must be one of influx, mqtt, both", 3)
+	}
+	if (output == "influx" || output == "both") && url == "" {
 		return cli.NewExitError("You must specify a URL", 1)
 	}
-	if db == "" {
+	if (output == "influx" || output == "both") && db == "" {
 		return cli.NewExitError("You must specify a database", 2)
 	}
+	if (output == "mqtt" || output == "both") && mqttBroker == "" {
+		return cli.NewExitError("You must specify --mqtt-broker", 4)
+	}
+	if protocol != "http" && protocol != "udp" && protocol != "tcp-line" {
+		return cli.NewExitError("--protocol must be one of http, udp, tcp-line", 7)
+	}
 
-	done := make(chan bool)
-	cancel := make(chan bool, nw)
-	sig := make(chan os.Signal, 1)
-
-	cancel_workers := func() {
-		for i := 0; i < nw; i++ {
-			cancel <- true
+	// schemas is nil when no --config is given, meaning one worker pool
+	// using the hard-coded cpu_usage schema (Worker.Schema == nil).
+	var schemas []*RuntimeSchema
+	if configPath != "" {
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to load %s: %s", configPath, err), 5)
+		}
+		for _, spec := range cfg.Schemas {
+			rs, err := NewRuntimeSchema(spec)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("Bad schema %q: %s", spec.Measurement, err), 6)
+			}
+			schemas = append(schemas, rs)
 		}
 	}
 
-	await_workers := func() {
-		for i := 0; i < nw; i++ {
-			<-done
-		}
+	stats := NewStats()
+	if statsAddr != "" {
+		stats.Serve(statsAddr)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	sig := make(chan os.Signal, 1)
+
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
 		s := <-sig
 		log.WithFields(log.Fields{
 			"signal": s,
 		}).Debug("Exiting from signal")
-		cancel_workers()
+		cancel()
 	}()
 
-	for i := 0; i < nw; i++ {
-		w := NewWorker(fmt.Sprintf("%s-%05d", hp, i), db, url, np, iv, wto, cancel, done)
-		if w != nil {
-			go func() {
-				// randomize the start of each worker with a delay of 0.0 - 1.0 sec
-				time.Sleep(time.Millisecond * time.Duration(rand.Float64()*1000))
-				w.Work()
-			}()
+	spawn := func(hostname string, numpoints int, interval float64, schema *RuntimeSchema) {
+		w := NewWorker(WorkerConfig{
+			Hostname:           hostname,
+			Output:             output,
+			Protocol:           protocol,
+			PayloadSize:        payloadSize,
+			DB:                 db,
+			URL:                url,
+			NumPoints:          numpoints,
+			Interval:           interval,
+			Timeout:            wto,
+			MinBackoff:         minBackoff,
+			MaxBackoff:         maxBackoff,
+			FailFast:           failFast,
+			Schema:             schema,
+			Stats:              stats,
+			MQTTBroker:         mqttBroker,
+			MQTTTopicPrefix:    mqttTopic,
+			MQTTUsername:       mqttUsername,
+			MQTTPassword:       mqttPassword,
+			MQTTClientIDPrefix: mqttClientIDPrefix,
+			MQTTQoS:            mqttQoS,
+		})
+		if w == nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			// randomize the start of each worker with a delay of 0.0 - 1.0
+			// sec; this must still respect ctx, or a SIGINT landing during
+			// this delay (before Work's select loop is even running) would
+			// otherwise block shutdown until the delay elapses.
+			if !sleep(ctx, time.Millisecond*time.Duration(rand.Float64()*1000)) {
+				wg.Done()
+				return
+			}
+			w.Work(ctx, &wg)
+		}()
+	}
+
+	if schemas == nil {
+		for i := 0; i < nw; i++ {
+			spawn(fmt.Sprintf("%s-%05d", hp, i), np, iv, nil)
+		}
+	} else {
+		for _, schema := range schemas {
+			for i := 0; i < nw; i++ {
+				spawn(fmt.Sprintf("%s-%05d", hp, i), schema.BatchSize, schema.Interval.Seconds(), schema)
+			}
 		}
 	}
 
 	select {
 	case <-time.After(time.Second * time.Duration(to)):
-		cancel_workers()
+		cancel()
+	case <-ctx.Done():
 	}
 
-	await_workers()
+	wg.Wait()
+
+	// The final summary is the one piece of ground truth this whole
+	// command exists to provide, so it's printed unconditionally instead
+	// of going through logrus, where it would be silently suppressed at
+	// the default --log-level=error.
+	fmt.Println(stats.Summary())
 
 	return nil
 }
@@ -278,6 +498,71 @@ func main() {
 			Name:  "debug, d",
 			Usage: "Run in debug mode",
 		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Output protocol(s) to write generated points to (options: influx, mqtt, both)",
+			Value: DEF_OUTPUT,
+		},
+		cli.StringFlag{
+			Name:  "mqtt-broker",
+			Usage: "MQTT broker URL, e.g. tcp://localhost:1883",
+		},
+		cli.StringFlag{
+			Name:  "mqtt-topic",
+			Usage: "MQTT topic prefix, points are published to {prefix}/{hostname}/{measurement}",
+			Value: DEF_MQTT_TOPIC,
+		},
+		cli.UintFlag{
+			Name:  "mqtt-qos",
+			Usage: "MQTT QoS level (0, 1 or 2)",
+			Value: DEF_MQTT_QOS,
+		},
+		cli.StringFlag{
+			Name:  "mqtt-username",
+			Usage: "Username for MQTT broker authentication",
+		},
+		cli.StringFlag{
+			Name:  "mqtt-password",
+			Usage: "Password for MQTT broker authentication",
+		},
+		cli.StringFlag{
+			Name:  "mqtt-client-id-prefix",
+			Usage: "Prefix for the per-worker MQTT client ID",
+			Value: DEF_MQTT_CLIENTID,
+		},
+		cli.Float64Flag{
+			Name:  "min-backoff",
+			Usage: "Minimum backoff (in seconds) to wait after a failed write",
+			Value: DEF_MIN_BACKOFF,
+		},
+		cli.Float64Flag{
+			Name:  "max-backoff",
+			Usage: "Maximum backoff (in seconds) to wait after consecutive failed writes",
+			Value: DEF_MAX_BACKOFF,
+		},
+		cli.IntFlag{
+			Name:  "fail-fast",
+			Usage: "Cancel a worker after N consecutive write failures (0 disables)",
+			Value: DEF_FAIL_FAST,
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "Path to a YAML file declaring one or more synthetic measurement schemas, replacing the built-in cpu_usage default",
+		},
+		cli.StringFlag{
+			Name:  "protocol",
+			Usage: "Wire protocol to use against the InfluxDB endpoint (options: http, udp, tcp-line)",
+			Value: DEF_PROTOCOL,
+		},
+		cli.IntFlag{
+			Name:  "payload-size",
+			Usage: "Max UDP datagram payload size in bytes, used to split batches when --protocol=udp",
+			Value: DEF_PAYLOAD_SIZE,
+		},
+		cli.StringFlag{
+			Name:  "stats-addr",
+			Usage: "Address (e.g. :9999) to serve Prometheus-format self-stats on /metrics; disabled if unset",
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -0,0 +1,305 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TagSpec describes how to generate the values for a single tag key, as
+// read straight out of the YAML config.
+type TagSpec struct {
+	Key       string   `yaml:"key"`
+	Generator string   `yaml:"generator"` // enum, random-int, random-choice-from-file, sequential
+	Values    []string `yaml:"values,omitempty"`
+	Min       int      `yaml:"min,omitempty"`
+	Max       int      `yaml:"max,omitempty"`
+	File      string   `yaml:"file,omitempty"`
+}
+
+// FieldSpec describes how to generate the values for a single field key.
+type FieldSpec struct {
+	Key       string  `yaml:"key"`
+	Generator string  `yaml:"generator"` // gauss, uniform, counter, sine, boolean
+	Mean      float64 `yaml:"mean,omitempty"`
+	Stddev    float64 `yaml:"stddev,omitempty"`
+	Min       float64 `yaml:"min,omitempty"`
+	Max       float64 `yaml:"max,omitempty"`
+	Step      float64 `yaml:"step,omitempty"`
+	Amplitude float64 `yaml:"amplitude,omitempty"`
+	Period    float64 `yaml:"period,omitempty"`
+}
+
+// SchemaSpec is a single synthetic measurement, as read out of the YAML
+// config. Measurement/batch-size/interval mirror what the CLI flags
+// describe for the hard-coded default schema.
+type SchemaSpec struct {
+	Measurement string      `yaml:"measurement"`
+	Tags        []TagSpec   `yaml:"tags"`
+	Fields      []FieldSpec `yaml:"fields"`
+	BatchSize   int         `yaml:"batch_size"`
+	Interval    float64     `yaml:"interval"`
+}
+
+// Config is the top-level shape of a --config schemas.yml file.
+type Config struct {
+	Schemas []SchemaSpec `yaml:"schemas"`
+}
+
+// LoadConfig reads and parses a YAML schema config file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// TagGenerator produces successive values for a tag key.
+type TagGenerator interface {
+	Next() string
+}
+
+// FieldGenerator produces successive values for a field key.
+type FieldGenerator interface {
+	Next() interface{}
+}
+
+type enumGenerator struct {
+	values []string
+}
+
+func (g *enumGenerator) Next() string {
+	return g.values[rand.Intn(len(g.values))]
+}
+
+type sequentialGenerator struct {
+	values []string
+	idx    int
+}
+
+func (g *sequentialGenerator) Next() string {
+	v := g.values[g.idx%len(g.values)]
+	g.idx++
+	return v
+}
+
+type randomIntGenerator struct {
+	min, max int
+}
+
+func (g *randomIntGenerator) Next() string {
+	return fmt.Sprintf("%d", g.min+rand.Intn(g.max-g.min+1))
+}
+
+type randomChoiceFileGenerator struct {
+	values []string
+}
+
+func (g *randomChoiceFileGenerator) Next() string {
+	return g.values[rand.Intn(len(g.values))]
+}
+
+// readLines reads a file into one string per non-empty line, for use by
+// random-choice-from-file tag generators.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func NewTagGenerator(spec TagSpec) (TagGenerator, error) {
+	switch spec.Generator {
+	case "enum":
+		if len(spec.Values) == 0 {
+			return nil, fmt.Errorf("tag %q: enum generator needs a non-empty values list", spec.Key)
+		}
+		return &enumGenerator{values: spec.Values}, nil
+	case "sequential":
+		if len(spec.Values) == 0 {
+			return nil, fmt.Errorf("tag %q: sequential generator needs a non-empty values list", spec.Key)
+		}
+		return &sequentialGenerator{values: spec.Values}, nil
+	case "random-int":
+		if spec.Max < spec.Min {
+			return nil, fmt.Errorf("tag %q: random-int generator needs max >= min, got min=%d max=%d", spec.Key, spec.Min, spec.Max)
+		}
+		return &randomIntGenerator{min: spec.Min, max: spec.Max}, nil
+	case "random-choice-from-file":
+		values, err := readLines(spec.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("tag %q: random-choice-from-file generator found no values in %q", spec.Key, spec.File)
+		}
+		return &randomChoiceFileGenerator{values: values}, nil
+	default:
+		return nil, fmt.Errorf("unknown tag generator: %q", spec.Generator)
+	}
+}
+
+type gaussGenerator struct {
+	mean, stddev float64
+}
+
+func (g *gaussGenerator) Next() interface{} {
+	return rand.NormFloat64()*g.stddev + g.mean
+}
+
+type uniformGenerator struct {
+	min, max float64
+}
+
+func (g *uniformGenerator) Next() interface{} {
+	return g.min + rand.Float64()*(g.max-g.min)
+}
+
+type counterGenerator struct {
+	step  float64
+	value float64
+}
+
+func (g *counterGenerator) Next() interface{} {
+	g.value += g.step
+	return g.value
+}
+
+type sineGenerator struct {
+	amplitude, period float64
+	tick              float64
+}
+
+func (g *sineGenerator) Next() interface{} {
+	v := g.amplitude * math.Sin(2*math.Pi*g.tick/g.period)
+	g.tick++
+	return v
+}
+
+type booleanGenerator struct{}
+
+func (g *booleanGenerator) Next() interface{} {
+	return rand.Intn(2) == 1
+}
+
+func NewFieldGenerator(spec FieldSpec) (FieldGenerator, error) {
+	switch spec.Generator {
+	case "gauss":
+		return &gaussGenerator{mean: spec.Mean, stddev: spec.Stddev}, nil
+	case "uniform":
+		return &uniformGenerator{min: spec.Min, max: spec.Max}, nil
+	case "counter":
+		return &counterGenerator{step: spec.Step}, nil
+	case "sine":
+		return &sineGenerator{amplitude: spec.Amplitude, period: spec.Period}, nil
+	case "boolean":
+		return &booleanGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown field generator: %q", spec.Generator)
+	}
+}
+
+// RuntimeSchema is a SchemaSpec with its generators instantiated, ready
+// to be handed to one or more Workers.
+type RuntimeSchema struct {
+	Measurement string
+	TagKeys     []string
+	TagGens     []TagGenerator
+	FieldKeys   []string
+	FieldGens   []FieldGenerator
+	BatchSize   int
+	Interval    time.Duration
+}
+
+// NewRuntimeSchema instantiates all the tag/field generators a SchemaSpec
+// declares.
+func NewRuntimeSchema(spec SchemaSpec) (*RuntimeSchema, error) {
+	if spec.BatchSize <= 0 {
+		return nil, fmt.Errorf("schema %q: batch_size must be > 0, got %d", spec.Measurement, spec.BatchSize)
+	}
+	if spec.Interval <= 0 {
+		return nil, fmt.Errorf("schema %q: interval must be > 0, got %g", spec.Measurement, spec.Interval)
+	}
+	rs := &RuntimeSchema{
+		Measurement: spec.Measurement,
+		BatchSize:   spec.BatchSize,
+		Interval:    time.Duration(spec.Interval*1000) * time.Millisecond,
+	}
+	for _, t := range spec.Tags {
+		g, err := NewTagGenerator(t)
+		if err != nil {
+			return nil, err
+		}
+		rs.TagKeys = append(rs.TagKeys, t.Key)
+		rs.TagGens = append(rs.TagGens, g)
+	}
+	for _, f := range spec.Fields {
+		g, err := NewFieldGenerator(f)
+		if err != nil {
+			return nil, err
+		}
+		rs.FieldKeys = append(rs.FieldKeys, f.Key)
+		rs.FieldGens = append(rs.FieldGens, g)
+	}
+	return rs, nil
+}
+
+// Points generates one batch of points for this schema, tagged with the
+// given hostname in addition to whatever the schema itself declares.
+func (rs *RuntimeSchema) Points(hostname string) ([]*client.Point, error) {
+	points := make([]*client.Point, 0, rs.BatchSize)
+	for i := 0; i < rs.BatchSize; i++ {
+		tags := map[string]string{"host": hostname}
+		for j, key := range rs.TagKeys {
+			tags[key] = rs.TagGens[j].Next()
+		}
+		fields := make(map[string]interface{}, len(rs.FieldKeys))
+		for j, key := range rs.FieldKeys {
+			fields[key] = rs.FieldGens[j].Next()
+		}
+		p, err := client.NewPoint(rs.Measurement, tags, fields, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNewTagGeneratorValidation(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    TagSpec
+		wantErr bool
+	}{
+		{"enum with values", TagSpec{Generator: "enum", Values: []string{"a", "b"}}, false},
+		{"enum empty values", TagSpec{Generator: "enum"}, true},
+		{"sequential with values", TagSpec{Generator: "sequential", Values: []string{"a"}}, false},
+		{"sequential empty values", TagSpec{Generator: "sequential"}, true},
+		{"random-int valid range", TagSpec{Generator: "random-int", Min: 1, Max: 10}, false},
+		{"random-int equal bounds", TagSpec{Generator: "random-int", Min: 5, Max: 5}, false},
+		{"random-int inverted range", TagSpec{Generator: "random-int", Min: 10, Max: 1}, true},
+		{"unknown generator", TagSpec{Generator: "bogus"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewTagGenerator(c.spec)
+			if c.wantErr && err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestNewTagGeneratorRandomChoiceFromFileMissingFile(t *testing.T) {
+	if _, err := NewTagGenerator(TagSpec{Generator: "random-choice-from-file", File: "/nonexistent/path/to/values.txt"}); err == nil {
+		t.Fatal("expected error for missing file, got nil")
+	}
+}
+
+func TestGeneratorsStayInBounds(t *testing.T) {
+	tg, err := NewTagGenerator(TagSpec{Generator: "random-int", Min: 3, Max: 7})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		v, err := strconv.Atoi(tg.Next())
+		if err != nil || v < 3 || v > 7 {
+			t.Fatalf("random-int.Next() = %d (err %v), want an int in [3, 7]", v, err)
+		}
+	}
+
+	seq, err := NewTagGenerator(TagSpec{Generator: "sequential", Values: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{"a", "b", "c", "a", "b"}
+	for i, w := range want {
+		if got := seq.Next(); got != w {
+			t.Fatalf("sequential.Next() #%d = %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestNewFieldGeneratorUnknown(t *testing.T) {
+	if _, err := NewFieldGenerator(FieldSpec{Generator: "bogus"}); err == nil {
+		t.Fatal("expected error for unknown field generator, got nil")
+	}
+}
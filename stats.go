@@ -0,0 +1,139 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Stats tracks the stressor's own throughput, independent of whatever the
+// server on the other end reports, so users have ground truth for what
+// was actually sent.
+type Stats struct {
+	PointsWritten  uint64
+	PointsDropped  uint64
+	BatchesWritten uint64
+	WriteErrors    uint64
+	Latency        metrics.Histogram
+	StartedAt      time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Latency:   metrics.NewHistogram(metrics.NewUniformSample(4096)),
+		StartedAt: time.Now(),
+	}
+}
+
+// RecordWrite is called once per Writer.Write attempt made by
+// Worker.Write, successful or not. A Worker.Write that fails while
+// building its points makes no attempt and records nothing.
+func (s *Stats) RecordWrite(numPoints int, d time.Duration, err error) {
+	atomic.AddUint64(&s.BatchesWritten, 1)
+	if err != nil {
+		atomic.AddUint64(&s.WriteErrors, 1)
+		return
+	}
+	atomic.AddUint64(&s.PointsWritten, uint64(numPoints))
+	s.Latency.Update(d.Nanoseconds())
+}
+
+// RecordDrop accounts for points that were built and attempted at least
+// once but never confirmed written, because the worker stopped (was
+// cancelled while they sat in backoff, or gave up via --fail-fast)
+// before a later write succeeded.
+func (s *Stats) RecordDrop(numPoints int) {
+	atomic.AddUint64(&s.PointsDropped, uint64(numPoints))
+}
+
+// ServeHTTP exposes the counters in Prometheus text exposition format.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	points := atomic.LoadUint64(&s.PointsWritten)
+	dropped := atomic.LoadUint64(&s.PointsDropped)
+	batches := atomic.LoadUint64(&s.BatchesWritten)
+	errs := atomic.LoadUint64(&s.WriteErrors)
+	snap := s.Latency.Snapshot()
+	percentiles := snap.Percentiles([]float64{0.5, 0.95, 0.99})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP influx_killer_points_written_total Total points written successfully.\n")
+	fmt.Fprintf(w, "# TYPE influx_killer_points_written_total counter\n")
+	fmt.Fprintf(w, "influx_killer_points_written_total %d\n", points)
+	fmt.Fprintf(w, "# HELP influx_killer_points_dropped_total Total points dropped on shutdown without being confirmed written.\n")
+	fmt.Fprintf(w, "# TYPE influx_killer_points_dropped_total counter\n")
+	fmt.Fprintf(w, "influx_killer_points_dropped_total %d\n", dropped)
+	fmt.Fprintf(w, "# HELP influx_killer_batches_written_total Total batch writes attempted.\n")
+	fmt.Fprintf(w, "# TYPE influx_killer_batches_written_total counter\n")
+	fmt.Fprintf(w, "influx_killer_batches_written_total %d\n", batches)
+	fmt.Fprintf(w, "# HELP influx_killer_write_errors_total Total failed batch writes.\n")
+	fmt.Fprintf(w, "# TYPE influx_killer_write_errors_total counter\n")
+	fmt.Fprintf(w, "influx_killer_write_errors_total %d\n", errs)
+	fmt.Fprintf(w, "# HELP influx_killer_write_latency_seconds Write latency quantiles.\n")
+	fmt.Fprintf(w, "# TYPE influx_killer_write_latency_seconds summary\n")
+	fmt.Fprintf(w, "influx_killer_write_latency_seconds{quantile=\"0.5\"} %f\n", time.Duration(percentiles[0]).Seconds())
+	fmt.Fprintf(w, "influx_killer_write_latency_seconds{quantile=\"0.95\"} %f\n", time.Duration(percentiles[1]).Seconds())
+	fmt.Fprintf(w, "influx_killer_write_latency_seconds{quantile=\"0.99\"} %f\n", time.Duration(percentiles[2]).Seconds())
+}
+
+// Serve starts the embedded stats HTTP server in the background. Errors
+// are logged, not fatal, since losing the stats endpoint shouldn't stop
+// the stress test itself.
+func (s *Stats) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.ServeHTTP)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WithFields(log.Fields{
+				"addr":  addr,
+				"error": err,
+			}).Error("Stats server")
+		}
+	}()
+}
+
+// Summary renders the final p50/p95/p99/throughput report printed on
+// shutdown.
+func (s *Stats) Summary() string {
+	points := atomic.LoadUint64(&s.PointsWritten)
+	dropped := atomic.LoadUint64(&s.PointsDropped)
+	batches := atomic.LoadUint64(&s.BatchesWritten)
+	errs := atomic.LoadUint64(&s.WriteErrors)
+	elapsed := time.Since(s.StartedAt).Seconds()
+	snap := s.Latency.Snapshot()
+	percentiles := snap.Percentiles([]float64{0.5, 0.95, 0.99})
+
+	var errRate float64
+	if batches > 0 {
+		errRate = float64(errs) / float64(batches) * 100
+	}
+	var pointsPerSec float64
+	if elapsed > 0 {
+		pointsPerSec = float64(points) / elapsed
+	}
+
+	return fmt.Sprintf(
+		"total_points=%d points_dropped=%d batches=%d errors=%d error_rate=%.2f%% points_per_sec=%.1f p50=%s p95=%s p99=%s",
+		points, dropped, batches, errs, errRate, pointsPerSec,
+		time.Duration(percentiles[0]), time.Duration(percentiles[1]), time.Duration(percentiles[2]),
+	)
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsRecordWriteSuccess(t *testing.T) {
+	s := NewStats()
+	s.RecordWrite(10, 5*time.Millisecond, nil)
+	s.RecordWrite(5, 10*time.Millisecond, nil)
+
+	if s.PointsWritten != 15 {
+		t.Fatalf("PointsWritten = %d, want 15", s.PointsWritten)
+	}
+	if s.BatchesWritten != 2 {
+		t.Fatalf("BatchesWritten = %d, want 2", s.BatchesWritten)
+	}
+	if s.WriteErrors != 0 {
+		t.Fatalf("WriteErrors = %d, want 0", s.WriteErrors)
+	}
+}
+
+func TestStatsRecordWriteError(t *testing.T) {
+	s := NewStats()
+	s.RecordWrite(10, 5*time.Millisecond, errBoom)
+
+	if s.PointsWritten != 0 {
+		t.Fatalf("PointsWritten = %d, want 0 on error", s.PointsWritten)
+	}
+	if s.BatchesWritten != 1 {
+		t.Fatalf("BatchesWritten = %d, want 1", s.BatchesWritten)
+	}
+	if s.WriteErrors != 1 {
+		t.Fatalf("WriteErrors = %d, want 1", s.WriteErrors)
+	}
+}
+
+func TestStatsRecordDrop(t *testing.T) {
+	s := NewStats()
+	s.RecordDrop(7)
+	s.RecordDrop(3)
+
+	if s.PointsDropped != 10 {
+		t.Fatalf("PointsDropped = %d, want 10", s.PointsDropped)
+	}
+}
+
+func TestStatsSummary(t *testing.T) {
+	s := NewStats()
+	s.RecordWrite(100, time.Millisecond, nil)
+	s.RecordWrite(0, 0, errBoom)
+	s.RecordDrop(4)
+
+	summary := s.Summary()
+	for _, want := range []string{"total_points=100", "points_dropped=4", "batches=2", "errors=1", "error_rate=50.00%"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("Summary() = %q, missing %q", summary, want)
+		}
+	}
+}
+
+var errBoom = &testError{"boom"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }
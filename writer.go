@@ -0,0 +1,300 @@
+/*
+   Copyright 2017 Odd Eivind Ebbesen
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// PointWriter abstracts over the wire protocol used to deliver generated
+// points somewhere. A Worker doesn't care whether that somewhere is an
+// InfluxDB HTTP endpoint or an MQTT broker.
+type PointWriter interface {
+	Write(points []*client.Point) error
+	Close() error
+}
+
+// InfluxHTTPWriter writes points to InfluxDB over its HTTP write API.
+type InfluxHTTPWriter struct {
+	Client client.Client
+	DB     string
+}
+
+func NewInfluxHTTPWriter(addr, db string, timeout float64) (*InfluxHTTPWriter, error) {
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:    addr,
+		Timeout: time.Duration(timeout*1000) * time.Millisecond,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &InfluxHTTPWriter{Client: c, DB: db}, nil
+}
+
+func (iw *InfluxHTTPWriter) Write(points []*client.Point) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  iw.DB,
+		Precision: "ms",
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		bp.AddPoint(p)
+	}
+	return iw.Client.Write(bp)
+}
+
+func (iw *InfluxHTTPWriter) Close() error {
+	return iw.Client.Close()
+}
+
+// InfluxUDPWriter writes points to InfluxDB's UDP listener/subscription
+// service. The client library itself splits the batch into sub-batches
+// below PayloadSize, so one write can turn into several datagrams.
+type InfluxUDPWriter struct {
+	Client client.Client
+}
+
+func NewInfluxUDPWriter(addr string, payloadSize int) (*InfluxUDPWriter, error) {
+	c, err := client.NewUDPClient(client.UDPConfig{
+		Addr:        addr,
+		PayloadSize: payloadSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &InfluxUDPWriter{Client: c}, nil
+}
+
+func (uw *InfluxUDPWriter) Write(points []*client.Point) error {
+	// UDP writes carry no database/retention-policy; that's configured on
+	// the InfluxDB UDP listener itself.
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{})
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		bp.AddPoint(p)
+	}
+	return uw.Client.Write(bp)
+}
+
+func (uw *InfluxUDPWriter) Close() error {
+	return uw.Client.Close()
+}
+
+// InfluxTCPLineWriter streams points as raw InfluxDB line protocol over a
+// plain TCP connection, reconnecting on the next Write if the connection
+// was dropped. This is how Influx's TCP line-protocol listener expects
+// data, as opposed to the HTTP write API. Both the dial and every write
+// honor Timeout, the same --write-timeout the HTTP/UDP writers use, so a
+// stalled listener can't block a worker indefinitely.
+type InfluxTCPLineWriter struct {
+	Addr    string
+	Timeout time.Duration
+	conn    net.Conn
+}
+
+func NewInfluxTCPLineWriter(addr string, timeout time.Duration) (*InfluxTCPLineWriter, error) {
+	tw := &InfluxTCPLineWriter{Addr: addr, Timeout: timeout}
+	if err := tw.connect(); err != nil {
+		return nil, err
+	}
+	return tw, nil
+}
+
+func (tw *InfluxTCPLineWriter) connect() error {
+	conn, err := net.DialTimeout("tcp", tw.Addr, tw.Timeout)
+	if err != nil {
+		return err
+	}
+	tw.conn = conn
+	return nil
+}
+
+func (tw *InfluxTCPLineWriter) Write(points []*client.Point) error {
+	if tw.conn == nil {
+		if err := tw.connect(); err != nil {
+			return err
+		}
+	}
+	if err := tw.conn.SetWriteDeadline(time.Now().Add(tw.Timeout)); err != nil {
+		return err
+	}
+	for _, p := range points {
+		if _, err := fmt.Fprintf(tw.conn, "%s\n", p.String()); err != nil {
+			tw.conn.Close()
+			tw.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (tw *InfluxTCPLineWriter) Close() error {
+	if tw.conn == nil {
+		return nil
+	}
+	return tw.conn.Close()
+}
+
+// newInfluxWriter is the factory for the InfluxDB-facing writer, picking
+// the wire protocol behind the single PointWriter interface every Worker
+// talks to.
+func newInfluxWriter(protocol, addr, db string, timeout float64, payloadSize int) (PointWriter, error) {
+	switch protocol {
+	case "http", "":
+		return NewInfluxHTTPWriter(addr, db, timeout)
+	case "udp":
+		return NewInfluxUDPWriter(addr, payloadSize)
+	case "tcp-line":
+		return NewInfluxTCPLineWriter(addr, time.Duration(timeout*1000)*time.Millisecond)
+	default:
+		return nil, fmt.Errorf("unknown protocol: %q", protocol)
+	}
+}
+
+// MQTTWriter publishes each point as InfluxDB line protocol to a per-host
+// topic on an MQTT broker, so Telegraf (or any other) MQTT-consumer
+// pipelines can be stress-tested the same way the HTTP endpoint is.
+type MQTTWriter struct {
+	Client MQTT.Client
+	Topic  string
+	QoS    byte
+}
+
+func NewMQTTWriter(broker, clientID, username, password, topic string, qos uint) (*MQTTWriter, error) {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	if username != "" {
+		opts.SetUsername(username)
+	}
+	if password != "" {
+		opts.SetPassword(password)
+	}
+
+	c := MQTT.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return &MQTTWriter{
+		Client: c,
+		Topic:  topic,
+		QoS:    byte(qos),
+	}, nil
+}
+
+func (mw *MQTTWriter) Write(points []*client.Point) error {
+	for _, p := range points {
+		token := mw.Client.Publish(mw.Topic, mw.QoS, false, p.String())
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *MQTTWriter) Close() error {
+	mw.Client.Disconnect(250)
+	return nil
+}
+
+// multiWriter fans a single Write out to several PointWriters, used for
+// --output=both. The first error encountered is returned, but every
+// writer is still given a chance to run.
+type multiWriter struct {
+	writers []PointWriter
+}
+
+func (mw *multiWriter) Write(points []*client.Point) error {
+	var first error
+	for _, w := range mw.writers {
+		if err := w.Write(points); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (mw *multiWriter) Close() error {
+	var first error
+	for _, w := range mw.writers {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// mqttTopicFor builds the `{prefix}/{hostname}/{measurement}` topic for a
+// given simulated host.
+func mqttTopicFor(prefix, hostname, measurement string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, hostname, measurement)
+}
+
+// mqttClientIDFor qualifies the client ID with the measurement name, the
+// same way mqttTopicFor qualifies the topic. Without this, workers for
+// different schemas but the same host index would connect with identical
+// client IDs, and the broker would keep kicking each other off per the
+// MQTT clean-session spec.
+func mqttClientIDFor(prefix, hostname, measurement string) string {
+	return fmt.Sprintf("%s-%s-%s", prefix, hostname, measurement)
+}
+
+func newWriters(output, protocol string, hostname, url, db string, timeout float64, payloadSize int, mqttBroker, mqttTopicPrefix, mqttUsername, mqttPassword, mqttClientIDPrefix, measurement string, mqttQoS uint) (PointWriter, error) {
+	var writers []PointWriter
+
+	if output == "influx" || output == "both" {
+		iw, err := newInfluxWriter(protocol, url, db, timeout, payloadSize)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"worker":   hostname,
+				"protocol": protocol,
+				"error":    err,
+			}).Error("Create InfluxDB writer")
+			return nil, err
+		}
+		writers = append(writers, iw)
+	}
+
+	if output == "mqtt" || output == "both" {
+		mw, err := NewMQTTWriter(mqttBroker, mqttClientIDFor(mqttClientIDPrefix, hostname, measurement), mqttUsername, mqttPassword, mqttTopicFor(mqttTopicPrefix, hostname, measurement), mqttQoS)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"worker": hostname,
+				"error":  err,
+			}).Error("Create MQTT writer")
+			return nil, err
+		}
+		writers = append(writers, mw)
+	}
+
+	if len(writers) == 1 {
+		return writers[0], nil
+	}
+	return &multiWriter{writers: writers}, nil
+}